@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ErrUnauthorized is returned by an Authorizer when the request doesn't
+// carry valid credentials for the topic.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authorizer decides whether a request may subscribe to or publish on a
+// topic. It's checked before any channel registration or message append.
+type Authorizer interface {
+	CanSubscribe(topic string, r *http.Request) error
+	CanPublish(topic string, r *http.Request) error
+}
+
+// AllowAll is the Authorizer used when no ACL file is configured,
+// preserving the historical "anyone can do anything" behavior.
+type AllowAll struct{}
+
+func (AllowAll) CanSubscribe(topic string, r *http.Request) error { return nil }
+func (AllowAll) CanPublish(topic string, r *http.Request) error   { return nil }
+
+// aclRule maps a topic glob pattern (as matched by path.Match) to the
+// credentials required to read and/or write matching topics. An empty
+// token/user leaves that side of the rule open.
+type aclRule struct {
+	Pattern    string `json:"pattern"`
+	ReadToken  string `json:"read_token,omitempty"`
+	WriteToken string `json:"write_token,omitempty"`
+	BasicUser  string `json:"basic_user,omitempty"`
+	BasicPass  string `json:"basic_pass,omitempty"`
+}
+
+// ACLAuthorizer enforces per-topic bearer token or HTTP Basic credentials
+// loaded from a JSON file of aclRules. Topics matching no rule are open.
+type ACLAuthorizer struct {
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+// LoadACLAuthorizer reads a JSON array of aclRules from filePath.
+func LoadACLAuthorizer(filePath string) (*ACLAuthorizer, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var rules []aclRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	return &ACLAuthorizer{rules: rules}, nil
+}
+
+// find returns the rule governing topic, preferring an exact-pattern match
+// over a glob so a freshly minted per-topic rule always wins over a
+// pre-existing broader pattern (e.g. "room-*") that also matches it.
+func (a *ACLAuthorizer) find(topic string) *aclRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for i := range a.rules {
+		if a.rules[i].Pattern == topic {
+			return &a.rules[i]
+		}
+	}
+	for i := range a.rules {
+		if ok, _ := path.Match(a.rules[i].Pattern, topic); ok {
+			return &a.rules[i]
+		}
+	}
+	return nil
+}
+
+func (a *ACLAuthorizer) CanSubscribe(topic string, r *http.Request) error {
+	rule := a.find(topic)
+	if rule == nil || (rule.ReadToken == "" && rule.BasicUser == "") {
+		return nil
+	}
+	if credentialsMatch(r, rule.ReadToken, rule.BasicUser, rule.BasicPass) {
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+func (a *ACLAuthorizer) CanPublish(topic string, r *http.Request) error {
+	rule := a.find(topic)
+	if rule == nil || (rule.WriteToken == "" && rule.BasicUser == "") {
+		return nil
+	}
+	if credentialsMatch(r, rule.WriteToken, rule.BasicUser, rule.BasicPass) {
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+// mint replaces (or adds) the exact-match rule for topic with freshly
+// generated read/write tokens, kept in memory only: restarting the process
+// reloads whatever is on disk in ACL_FILE.
+func (a *ACLAuthorizer) mint(topic string) (readToken, writeToken string) {
+	readToken = randomToken()
+	writeToken = randomToken()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.rules {
+		if a.rules[i].Pattern == topic {
+			a.rules[i].ReadToken = readToken
+			a.rules[i].WriteToken = writeToken
+			return readToken, writeToken
+		}
+	}
+	a.rules = append(a.rules, aclRule{Pattern: topic, ReadToken: readToken, WriteToken: writeToken})
+	return readToken, writeToken
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// credentialsMatch reports whether r carries the given bearer token or
+// Basic credentials. An empty expected value disables that check.
+func credentialsMatch(r *http.Request, token, basicUser, basicPass string) bool {
+	if token != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && strings.TrimPrefix(auth, "Bearer ") == token {
+			return true
+		}
+	}
+	if basicUser != "" {
+		user, pass, ok := r.BasicAuth()
+		if ok && user == basicUser && pass == basicPass {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenHandler mints a fresh read/write token pair for a topic, gated by
+// the master token configured via the ADMIN_TOKEN env var.
+func (app *App) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if app.adminToken == "" || r.Header.Get("Authorization") != "Bearer "+app.adminToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	acl, ok := app.authorizer.(*ACLAuthorizer)
+	if !ok {
+		http.Error(w, "token minting requires an ACL authorizer", http.StatusNotImplemented)
+		return
+	}
+	topic := mux.Vars(r)["topic"]
+	readToken, writeToken := acl.mint(topic)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Topic      string `json:"topic"`
+		ReadToken  string `json:"read_token"`
+		WriteToken string `json:"write_token"`
+	}{topic, readToken, writeToken})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// BackpressurePolicy controls what happens when a subscriber's buffered
+// channel is full and a new update is ready to be delivered.
+type BackpressurePolicy string
+
+const (
+	// DropOldest evicts the oldest buffered update to make room for the new one.
+	DropOldest BackpressurePolicy = "drop_oldest"
+	// DropNewest discards the new update, leaving the buffer untouched.
+	DropNewest BackpressurePolicy = "drop_newest"
+	// DisconnectSlow closes the subscriber's channel once it has dropped
+	// disconnectThreshold updates in a row, forcing a reconnect.
+	DisconnectSlow BackpressurePolicy = "disconnect_slow"
+)
+
+// disconnectThreshold is how many consecutive drops a DisconnectSlow
+// subscriber tolerates before its channel is closed out from under it.
+const disconnectThreshold = 50
+
+// defaultBackpressurePolicy returns the policy new subscribers are created
+// with, read from the BACKPRESSURE_POLICY env var (drop_newest by default,
+// matching the historical silent-drop behavior).
+func defaultBackpressurePolicy() BackpressurePolicy {
+	switch BackpressurePolicy(os.Getenv("BACKPRESSURE_POLICY")) {
+	case DropOldest:
+		return DropOldest
+	case DisconnectSlow:
+		return DisconnectSlow
+	default:
+		return DropNewest
+	}
+}
+
+// subscriber wraps a connection's channel with its format and backpressure
+// bookkeeping.
+type subscriber struct {
+	ch       chan []byte
+	format   string
+	policy   BackpressurePolicy
+	dropped  uint64 // atomic
+	lastDrop int64  // atomic, unix nanoseconds
+	closed   int32  // atomic, 1 once ch has been closed by DisconnectSlow
+}
+
+// recordDrop increments the subscriber's drop counters and the registry's
+// aggregate counter, returning the subscriber's new consecutive-drop count.
+func (s *subscriber) recordDrop(registry *Registry) uint64 {
+	n := atomic.AddUint64(&s.dropped, 1)
+	atomic.StoreInt64(&s.lastDrop, time.Now().UnixNano())
+	registry.addDropped(1)
+	return n
+}
+
+// dispatch delivers data to the subscriber, applying its backpressure
+// policy if the channel's buffer is full.
+func dispatch(s *subscriber, data []byte, registry *Registry) {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return
+	}
+	select {
+	case s.ch <- data:
+		atomic.StoreUint64(&s.dropped, 0)
+		return
+	default:
+	}
+	switch s.policy {
+	case DropOldest:
+		select {
+		case <-s.ch:
+			s.recordDrop(registry)
+		default:
+		}
+		select {
+		case s.ch <- data:
+		default:
+			s.recordDrop(registry)
+		}
+	case DisconnectSlow:
+		if s.recordDrop(registry) >= disconnectThreshold {
+			if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+				close(s.ch)
+			}
+		}
+	default: // DropNewest
+		s.recordDrop(registry)
+	}
+}
+
+// Registry tracks aggregate pub/sub stats across every topic, exposed via
+// the /metrics endpoint.
+type Registry struct {
+	subscribers int64 // atomic
+	published   uint64
+	dropped     uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) addSubscriber(n int64) { atomic.AddInt64(&r.subscribers, n) }
+func (r *Registry) addPublished(n uint64) { atomic.AddUint64(&r.published, n) }
+func (r *Registry) addDropped(n uint64)   { atomic.AddUint64(&r.dropped, n) }
+
+// MetricsHandler reports aggregate pub/sub stats in Prometheus text
+// exposition format.
+func (app *App) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	app.topicsMutex.RLock()
+	topics := len(app.topics)
+	app.topicsMutex.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP noscript_subscribers Current number of active subscribers.\n")
+	fmt.Fprintf(w, "# TYPE noscript_subscribers gauge\n")
+	fmt.Fprintf(w, "noscript_subscribers %d\n", atomic.LoadInt64(&app.registry.subscribers))
+	fmt.Fprintf(w, "# HELP noscript_topics Current number of active topics.\n")
+	fmt.Fprintf(w, "# TYPE noscript_topics gauge\n")
+	fmt.Fprintf(w, "noscript_topics %d\n", topics)
+	fmt.Fprintf(w, "# HELP noscript_messages_published_total Total messages published.\n")
+	fmt.Fprintf(w, "# TYPE noscript_messages_published_total counter\n")
+	fmt.Fprintf(w, "noscript_messages_published_total %d\n", atomic.LoadUint64(&app.registry.published))
+	fmt.Fprintf(w, "# HELP noscript_messages_dropped_total Total messages dropped due to backpressure.\n")
+	fmt.Fprintf(w, "# TYPE noscript_messages_dropped_total counter\n")
+	fmt.Fprintf(w, "noscript_messages_dropped_total %d\n", atomic.LoadUint64(&app.registry.dropped))
+}
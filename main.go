@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"html/template"
+	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +26,14 @@ const maxMsgLen = 1024
 // Number of buffered messages per connection
 const bufferSize = 5
 
+// Subscriber formats, used to render updates for different transports
+const (
+	formatHTML = "html"
+	formatText = "text"
+	formatJSON = "json"
+	formatSSE  = "sse"
+)
+
 // Leading portion of main page
 const pageHead = `<!doctype html>
 <html>
@@ -43,119 +54,189 @@ const pageHead = `<!doctype html>
 `
 
 func main() {
-	app := NewApp()
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "./data"
+	}
+	retention := retentionFromEnv()
+	var authorizer Authorizer = AllowAll{}
+	if aclFile := os.Getenv("ACL_FILE"); aclFile != "" {
+		acl, err := LoadACLAuthorizer(aclFile)
+		if err != nil {
+			fmt.Println("failed to load ACL file:", err)
+		} else {
+			authorizer = acl
+		}
+	}
+	app := NewApp(dataDir, retention, authorizer, os.Getenv("ADMIN_TOKEN"))
+	go app.compactionLoop(retention)
 	r := mux.NewRouter()
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/main", 302)
 	}).Methods("GET")
 	r.HandleFunc("/{topic}", app.GetHandler).Methods("GET")
 	r.HandleFunc("/{topic}", app.PostHandler).Methods("POST")
+	r.HandleFunc("/{topic}/ws", app.WsHandler)
+	r.HandleFunc("/{topic}/sse", app.SseHandler).Methods("GET")
+	r.HandleFunc("/{topic}/token", app.TokenHandler).Methods("POST")
+	r.HandleFunc("/metrics", app.MetricsHandler).Methods("GET")
 	fs := http.FileServer(http.Dir("./static/"))
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", fs))
+	if tcpPort := os.Getenv("TCP_PORT"); tcpPort != "" {
+		go func() {
+			if err := app.ServeTCP(":" + tcpPort); err != nil {
+				fmt.Println("tcp listener error:", err)
+			}
+		}()
+	}
 	port := os.Getenv("PORT")
 	addr := ":" + port
 	http.ListenAndServe(addr, r)
 }
 
-type Topic struct {
-	chansMutex   *sync.RWMutex
-	chans        map[chan []byte]struct{}
-	historyMutex *sync.RWMutex
-	history      []*Update
-}
-
-func NewTopic() *Topic {
-	return &Topic{
-		chansMutex:   &sync.RWMutex{},
-		chans:        make(map[chan []byte]struct{}),
-		historyMutex: &sync.RWMutex{},
-		history:      make([]*Update, 0),
-	}
-}
-
-func (t *Topic) append(update *Update) {
-	t.historyMutex.Lock()
-	defer t.historyMutex.Unlock()
-	t.history = append(t.history, update)
-	if len(t.history) > historyLimit {
-		t.history = t.history[len(t.history)-historyLimit:]
-	}
+// formatTimestamp renders a Created time the way the UI has always shown it.
+func formatTimestamp(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05")
 }
 
 func (t *Topic) updateCount() {
-	fmtstr := "<style>#nc::before{content:\"%d\"}</style>"
-	data := []byte(fmt.Sprintf(fmtstr, len(t.chans)))
+	n := len(t.chans)
 	t.chansMutex.RLock()
 	defer t.chansMutex.RUnlock()
-	for ch, _ := range t.chans {
-		select {
-		case ch <- data:
-		default:
-			continue
-		}
+	for _, sub := range t.chans {
+		dispatch(sub, renderCount(sub.format, n), t.registry)
 	}
 }
 
-func (t *Topic) send(update *Update) {
-	t.append(update)
-	fmtstr := "<div class=\"new\"><p>%s</p><time>%s</time></div>"
-	msg := fmt.Sprintf(fmtstr, update.message, update.timestamp)
-	data := []byte(msg)
+// send appends message as a new Update to the topic's WAL and fans it out
+// to every subscriber, subject to each subscriber's backpressure policy.
+func (t *Topic) send(message string) (*Update, error) {
+	update, err := t.append(message)
+	if err != nil {
+		return nil, err
+	}
+	t.registry.addPublished(1)
 	t.chansMutex.RLock()
 	defer t.chansMutex.RUnlock()
-	for ch, _ := range t.chans {
-		select {
-		case ch <- data:
-		default:
-			continue
-		}
+	for _, sub := range t.chans {
+		dispatch(sub, renderUpdate(sub.format, update, true), t.registry)
 	}
+	return update, nil
 }
 
-func (t *Topic) sendHistory(w http.ResponseWriter) error {
-	fmtstr := "<div><p>%s</p><time>%s</time></div>"
-	t.historyMutex.RLock()
-	defer t.historyMutex.RUnlock()
-	for _, update := range t.history {
-		msg := fmt.Sprintf(fmtstr, update.message, update.timestamp)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
+// sendHistory streams HTML history to an HTTP client, starting just after
+// since (0 replays the usual historyLimit window).
+func (t *Topic) sendHistory(w http.ResponseWriter, since int64) error {
+	return t.sendHistoryFormat(w, formatHTML, since)
+}
+
+func (t *Topic) sendHistoryFormat(w io.Writer, format string, since int64) error {
+	updates, err := t.readSince(since)
+	if err != nil {
+		return err
+	}
+	for _, update := range updates {
+		if _, err := w.Write(renderUpdate(format, update, false)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// renderUpdate renders an update for the given subscriber format. The
+// "new" class is only used for HTML live updates, not history replay.
+func renderUpdate(format string, update *Update, live bool) []byte {
+	timestamp := formatTimestamp(update.Created)
+	switch format {
+	case formatText:
+		return []byte(fmt.Sprintf("%s\t%s\n", timestamp, update.Message))
+	case formatJSON:
+		data, _ := json.Marshal(struct {
+			ID      int64  `json:"id"`
+			Time    string `json:"time"`
+			Message string `json:"message"`
+		}{update.ID, timestamp, update.Message})
+		return data
+	case formatSSE:
+		data := strings.ReplaceAll(update.Message, "\n", "\ndata: ")
+		return []byte(fmt.Sprintf("id: %d\ndata: %s\n\n", update.ID, data))
+	default:
+		class := ""
+		if live {
+			class = " class=\"new\""
+		}
+		return []byte(fmt.Sprintf("<div%s><p>%s</p><time>%s</time></div>", class, update.Message, timestamp))
+	}
+}
+
+// renderCount renders a connection-count update for the given subscriber format.
+func renderCount(format string, n int) []byte {
+	switch format {
+	case formatText:
+		return []byte(fmt.Sprintf("# %d connection(s)\n", n))
+	case formatJSON:
+		data, _ := json.Marshal(struct {
+			Count int `json:"count"`
+		}{n})
+		return data
+	case formatSSE:
+		return []byte(fmt.Sprintf("event: count\ndata: %d\n\n", n))
+	default:
+		return []byte(fmt.Sprintf("<style>#nc::before{content:\"%d\"}</style>", n))
+	}
+}
+
+// Update is a single published message. ID is the topic-local, monotonically
+// increasing WAL offset it was written at.
 type Update struct {
-	timestamp string
-	message   string
+	ID      int64     `json:"id"`
+	Created time.Time `json:"created"`
+	Message string    `json:"message"`
 }
 
 type App struct {
 	topicsMutex *sync.RWMutex
 	topics      map[string]*Topic
+	dataDir     string
+	retention   time.Duration
+	registry    *Registry
+	authorizer  Authorizer
+	adminToken  string
 }
 
-func NewApp() *App {
+func NewApp(dataDir string, retention time.Duration, authorizer Authorizer, adminToken string) *App {
 	return &App{
 		topicsMutex: &sync.RWMutex{},
 		topics:      make(map[string]*Topic),
+		dataDir:     dataDir,
+		retention:   retention,
+		registry:    NewRegistry(),
+		authorizer:  authorizer,
+		adminToken:  adminToken,
 	}
 }
 
-func (app *App) addChan(topic string, ch chan []byte) *Topic {
+func (app *App) addChan(topic string, ch chan []byte) (*Topic, error) {
+	return app.addChanFormat(topic, ch, formatHTML)
+}
+
+func (app *App) addChanFormat(topic string, ch chan []byte, format string) (*Topic, error) {
 	app.topicsMutex.Lock()
 	defer app.topicsMutex.Unlock()
 	t, ok := app.topics[topic]
-	if ok {
-		t.chansMutex.Lock()
-		defer t.chansMutex.Unlock()
-	} else {
-		t = NewTopic()
+	if !ok {
+		var err error
+		t, err = openTopic(app.dataDir, topic, app.registry)
+		if err != nil {
+			return nil, err
+		}
 		app.topics[topic] = t
 	}
-	t.chans[ch] = struct{}{}
-	return t
+	t.chansMutex.Lock()
+	defer t.chansMutex.Unlock()
+	t.chans[ch] = &subscriber{ch: ch, format: format, policy: defaultBackpressurePolicy()}
+	app.registry.addSubscriber(1)
+	return t, nil
 }
 
 func (app *App) removeChan(topic string, ch chan []byte) {
@@ -167,15 +248,39 @@ func (app *App) removeChan(topic string, ch chan []byte) {
 	}
 	t.chansMutex.Lock()
 	defer t.chansMutex.Unlock()
+	if _, ok := t.chans[ch]; !ok {
+		return
+	}
 	delete(t.chans, ch)
-	if len(t.chans) == 0 {
+	app.registry.addSubscriber(-1)
+	if len(t.chans) == 0 && !t.pinned() {
+		t.log.Close()
 		delete(app.topics, topic)
 	}
 }
 
+// sinceFromRequest reads a resume offset from the "since" query param or
+// the Last-Event-ID header, returning 0 (replay the default window) if
+// neither is present or parseable.
+func sinceFromRequest(r *http.Request) int64 {
+	raw := r.URL.Query().Get("since")
+	if raw == "" {
+		raw = r.Header.Get("Last-Event-ID")
+	}
+	since, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return since
+}
+
 func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	topic := vars["topic"]
+	if err := app.authorizer.CanSubscribe(topic, r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -183,22 +288,28 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// Create and register connection channel
 	ch := make(chan []byte, bufferSize)
-	t := app.addChan(topic, ch)
+	t, err := app.addChan(topic, ch)
+	if err != nil {
+		http.Error(w, "failed to open topic", http.StatusInternalServerError)
+		return
+	}
 	defer func() {
 		app.removeChan(topic, ch)
 		t.updateCount()
 	}()
 	// Write page head and history
 	w.Write([]byte(pageHead))
-	err := t.sendHistory(w)
-	if err != nil {
+	if err := t.sendHistory(w, sinceFromRequest(r)); err != nil {
 		return
 	}
 	flusher.Flush()
 	t.updateCount()
 	for {
 		select {
-		case msg := <-ch:
+		case msg, chOk := <-ch:
+			if !chOk {
+				return
+			}
 			_, err = w.Write(msg)
 			if err != nil {
 				return
@@ -216,6 +327,10 @@ func (app *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 func (app *App) PostHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	topic := vars["topic"]
+	if err := app.authorizer.CanPublish(topic, r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	app.topicsMutex.RLock()
 	defer app.topicsMutex.RUnlock()
 	t, ok := app.topics[topic]
@@ -232,8 +347,9 @@ func (app *App) PostHandler(w http.ResponseWriter, r *http.Request) {
 	msg = template.HTMLEscapeString(msg)
 	msg = strings.TrimSpace(msg)
 	if len(msg) > 0 {
-		timestamp := time.Now().UTC().Format("2006-01-02 15:04:05")
-		t.send(&Update{timestamp: timestamp, message: msg})
+		if _, err := t.send(msg); err != nil {
+			fmt.Println("failed to write update:", err)
+		}
 	}
 	http.Redirect(w, r, "/"+topic, 302)
 }
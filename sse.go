@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// SseHandler streams a topic as text/event-stream frames, honoring
+// Last-Event-ID (or ?since=) to replay events missed since a prior
+// connection instead of always dumping the default history window.
+func (app *App) SseHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	topic := vars["topic"]
+	if err := app.authorizer.CanSubscribe(topic, r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return
+	}
+	ch := make(chan []byte, bufferSize)
+	t, err := app.addChanFormat(topic, ch, formatSSE)
+	if err != nil {
+		http.Error(w, "failed to open topic", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		app.removeChan(topic, ch)
+		t.updateCount()
+	}()
+	if err := t.sendHistoryFormat(w, formatSSE, sinceFromRequest(r)); err != nil {
+		return
+	}
+	flusher.Flush()
+	t.updateCount()
+	for {
+		select {
+		case msg, chOk := <-ch:
+			if !chOk {
+				return
+			}
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+		case <-time.After(pingRate):
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Maximum length of a line read from a TCP client before giving up
+const tcpLineLimit = maxMsgLen + 256
+
+// ServeTCP listens on addr and serves the pub/sub protocol to plain TCP
+// clients: a line of the form "topic:message" publishes message to topic,
+// while a bare "topic" line subscribes the connection to that topic's
+// history and live updates as plain text.
+func (app *App) ServeTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			continue
+		}
+		go app.handleTCPConn(conn)
+	}
+}
+
+func (app *App) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, tcpLineLimit)
+	raw, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return
+	}
+	line := string(raw)
+	if err != nil {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return
+		}
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if topic, msg, ok := strings.Cut(line, ":"); ok {
+		app.publishTCP(topic, msg)
+		return
+	}
+	app.subscribeTCP(conn, line)
+}
+
+func (app *App) publishTCP(topic, msg string) {
+	msg = strings.TrimSpace(msg)
+	if len(msg) == 0 || len(msg) > maxMsgLen {
+		return
+	}
+	req, _ := http.NewRequest("POST", "/"+topic, nil)
+	if err := app.authorizer.CanPublish(topic, req); err != nil {
+		return
+	}
+	// Hold topicsMutex only for the lookup-or-create, not across the send:
+	// pinning t first keeps a concurrent removeChan/reapIdleTopics from
+	// closing its WAL out from under this write without serializing every
+	// other topic's traffic behind this one's disk I/O.
+	app.topicsMutex.Lock()
+	t, ok := app.topics[topic]
+	if !ok {
+		var err error
+		t, err = openTopic(app.dataDir, topic, app.registry)
+		if err != nil {
+			app.topicsMutex.Unlock()
+			return
+		}
+		app.topics[topic] = t
+	}
+	t.pin()
+	app.topicsMutex.Unlock()
+	t.send(msg)
+	t.unpin()
+}
+
+func (app *App) subscribeTCP(conn net.Conn, topic string) {
+	req, _ := http.NewRequest("GET", "/"+topic, nil)
+	if err := app.authorizer.CanSubscribe(topic, req); err != nil {
+		return
+	}
+	ch := make(chan []byte, bufferSize)
+	t, err := app.addChanFormat(topic, ch, formatText)
+	if err != nil {
+		return
+	}
+	defer app.removeChan(topic, ch)
+	if err := t.sendHistoryFormat(conn, formatText, 0); err != nil {
+		return
+	}
+	for {
+		select {
+		case msg, chOk := <-ch:
+			if !chOk {
+				return
+			}
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+		case <-time.After(pingRate):
+			if _, err := conn.Write([]byte{' '}); err != nil {
+				return
+			}
+		}
+	}
+}
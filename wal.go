@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/wal"
+)
+
+// Default retention window for WAL compaction, and how often to run it
+const (
+	defaultRetention   = 7 * 24 * time.Hour
+	compactionInterval = 1 * time.Hour
+)
+
+type Topic struct {
+	chansMutex   *sync.RWMutex
+	chans        map[chan []byte]*subscriber
+	historyMutex *sync.RWMutex
+	log          *wal.Log
+	nextID       int64
+	registry     *Registry
+	pinCount     int32 // atomic; in-flight senders holding t without topicsMutex
+}
+
+// pin marks the topic as in-use by a caller that's about to send without
+// holding app.topicsMutex, so removeChan/reapIdleTopics know not to close
+// its WAL out from under that send. unpin releases the mark.
+func (t *Topic) pin()         { atomic.AddInt32(&t.pinCount, 1) }
+func (t *Topic) unpin()       { atomic.AddInt32(&t.pinCount, -1) }
+func (t *Topic) pinned() bool { return atomic.LoadInt32(&t.pinCount) != 0 }
+
+// validTopicName matches the topic names openTopic will accept. It's
+// deliberately strict (no ".", "/" or "\") since, unlike the HTTP handlers,
+// the TCP transport hands topic names to openTopic with no router-level
+// path cleaning in front of it.
+var validTopicName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// openTopic opens (or creates) the on-disk WAL backing topic under dataDir,
+// picking up numbering where a previous run left off.
+func openTopic(dataDir, topic string, registry *Registry) (*Topic, error) {
+	if !validTopicName.MatchString(topic) {
+		return nil, fmt.Errorf("invalid topic name %q", topic)
+	}
+	path := filepath.Join(dataDir, topic)
+	log, err := wal.Open(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	last, err := log.LastIndex()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	return &Topic{
+		chansMutex:   &sync.RWMutex{},
+		chans:        make(map[chan []byte]*subscriber),
+		historyMutex: &sync.RWMutex{},
+		log:          log,
+		nextID:       int64(last) + 1,
+		registry:     registry,
+	}, nil
+}
+
+// append writes message to the WAL under the next sequence number and
+// returns the resulting Update.
+func (t *Topic) append(message string) (*Update, error) {
+	t.historyMutex.Lock()
+	defer t.historyMutex.Unlock()
+	update := &Update{
+		ID:      t.nextID,
+		Created: time.Now().UTC(),
+		Message: message,
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.log.Write(uint64(update.ID), data); err != nil {
+		return nil, err
+	}
+	t.nextID++
+	return update, nil
+}
+
+// readSince returns every Update after offset since, in order. An offset of
+// 0 instead replays the usual historyLimit window from the tail.
+func (t *Topic) readSince(since int64) ([]*Update, error) {
+	t.historyMutex.RLock()
+	defer t.historyMutex.RUnlock()
+	first, err := t.log.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	last, err := t.log.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	if first == 0 || last == 0 {
+		return nil, nil
+	}
+	var start uint64
+	if since > 0 {
+		start = uint64(since) + 1
+	} else if last-first+1 > historyLimit {
+		start = last - historyLimit + 1
+	} else {
+		start = first
+	}
+	if start < first {
+		start = first
+	}
+	if start > last {
+		return nil, nil
+	}
+	updates := make([]*Update, 0, last-start+1)
+	for idx := start; idx <= last; idx++ {
+		data, err := t.log.Read(idx)
+		if err != nil {
+			continue
+		}
+		var update Update
+		if err := json.Unmarshal(data, &update); err != nil {
+			continue
+		}
+		updates = append(updates, &update)
+	}
+	return updates, nil
+}
+
+// compact truncates entries older than retention off the front of the WAL.
+// The newest entry is always kept, even when it is older than retention.
+func (t *Topic) compact(retention time.Duration) error {
+	t.historyMutex.Lock()
+	defer t.historyMutex.Unlock()
+	first, err := t.log.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := t.log.LastIndex()
+	if err != nil {
+		return err
+	}
+	if first == 0 || last == 0 {
+		return nil
+	}
+	cutoff := time.Now().UTC().Add(-retention)
+	truncateTo := first
+	for idx := first; idx <= last; idx++ {
+		data, err := t.log.Read(idx)
+		if err != nil {
+			break
+		}
+		var update Update
+		if err := json.Unmarshal(data, &update); err != nil {
+			break
+		}
+		if update.Created.After(cutoff) {
+			break
+		}
+		truncateTo = idx + 1
+	}
+	if truncateTo > last {
+		truncateTo = last
+	}
+	if truncateTo <= first {
+		return nil
+	}
+	return t.log.TruncateFront(truncateTo)
+}
+
+// retentionFromEnv reads WAL_RETENTION (a time.Duration string) from the
+// environment, falling back to defaultRetention.
+func retentionFromEnv() time.Duration {
+	raw := os.Getenv("WAL_RETENTION")
+	if raw == "" {
+		return defaultRetention
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return defaultRetention
+	}
+	return d
+}
+
+// compactionLoop periodically compacts every open topic's WAL and reaps
+// topics left with no subscribers.
+func (app *App) compactionLoop(retention time.Duration) {
+	ticker := time.NewTicker(compactionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		app.reapIdleTopics()
+		app.topicsMutex.RLock()
+		topics := make([]*Topic, 0, len(app.topics))
+		for _, t := range app.topics {
+			topics = append(topics, t)
+		}
+		app.topicsMutex.RUnlock()
+		for _, t := range topics {
+			if err := t.compact(retention); err != nil {
+				fmt.Println("wal compaction error:", err)
+			}
+		}
+	}
+}
+
+// reapIdleTopics closes and forgets any topic with no subscribers, such as
+// one created purely by a publish that never gained a listener (e.g. a
+// publish-only TCP client), so its WAL file handle isn't held open for the
+// rest of the process's life.
+func (app *App) reapIdleTopics() {
+	app.topicsMutex.Lock()
+	defer app.topicsMutex.Unlock()
+	for name, t := range app.topics {
+		t.chansMutex.RLock()
+		idle := len(t.chans) == 0
+		t.chansMutex.RUnlock()
+		if idle && !t.pinned() {
+			t.log.Close()
+			delete(app.topics, name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Interval between WebSocket pings; pongWait is how long we'll wait for
+// the matching pong before considering the connection dead
+const (
+	wsPingRate = 30 * time.Second
+	wsPongWait = 60 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// WsHandler upgrades the connection to a WebSocket and multiplexes both
+// directions: incoming frames are posted to the topic like a form POST,
+// outgoing frames deliver JSON-encoded updates from the topic channel.
+func (app *App) WsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	topic := vars["topic"]
+	if err := app.authorizer.CanSubscribe(topic, r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := app.authorizer.CanPublish(topic, r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ch := make(chan []byte, bufferSize)
+	t, err := app.addChanFormat(topic, ch, formatJSON)
+	if err != nil {
+		return
+	}
+	defer func() {
+		app.removeChan(topic, ch)
+		t.updateCount()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+	go app.wsReadLoop(conn, t)
+
+	ticker := time.NewTicker(wsPingRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsReadLoop treats each incoming frame like a POST: HTML-escaped and
+// appended to the topic, subject to the same length limit.
+func (app *App) wsReadLoop(conn *websocket.Conn, t *Topic) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := string(data)
+		if len(msg) > maxMsgLen {
+			continue
+		}
+		msg = template.HTMLEscapeString(msg)
+		msg = strings.TrimSpace(msg)
+		if len(msg) > 0 {
+			t.send(msg)
+		}
+	}
+}